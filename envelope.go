@@ -0,0 +1,109 @@
+package cfmessagebus
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/nu7hatch/gouuid"
+)
+
+// Envelope is the wire format PublishTyped/SubscribeTyped use on top of
+// the raw []byte Publish/Subscribe. The outer Envelope is always JSON;
+// Payload holds the value encoded by whichever Codec produced it, named
+// by ContentType.
+type Envelope struct {
+	Subject       string    `json:"subject"`
+	Payload       []byte    `json:"payload"`
+	ContentType   string    `json:"content_type"`
+	CorrelationID string    `json:"correlation_id"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+// Codec encodes and decodes the typed value carried inside an Envelope's
+// Payload.
+type Codec interface {
+	ContentType() string
+	Encode(v interface{}) ([]byte, error)
+	Decode(data []byte, v interface{}) error
+}
+
+// JSONCodec is the default Codec: it marshals values with encoding/json.
+type JSONCodec struct{}
+
+func (JSONCodec) ContentType() string { return "application/json" }
+
+func (JSONCodec) Encode(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+func (JSONCodec) Decode(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// ProtobufCodec encodes and decodes values that implement proto.Message.
+type ProtobufCodec struct{}
+
+func (ProtobufCodec) ContentType() string { return "application/x-protobuf" }
+
+func (ProtobufCodec) Encode(v interface{}) ([]byte, error) {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("cfmessagebus: ProtobufCodec requires a proto.Message, got %T", v)
+	}
+
+	return proto.Marshal(msg)
+}
+
+func (ProtobufCodec) Decode(data []byte, v interface{}) error {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("cfmessagebus: ProtobufCodec requires a proto.Message, got %T", v)
+	}
+
+	return proto.Unmarshal(data, msg)
+}
+
+// SenMLRecord is one entry of a SenML pack (RFC 8428), the sensor
+// measurement format used by telemetry/IoT payloads.
+type SenMLRecord struct {
+	BaseName    string   `json:"bn,omitempty"`
+	BaseTime    float64  `json:"bt,omitempty"`
+	BaseUnit    string   `json:"bu,omitempty"`
+	Name        string   `json:"n,omitempty"`
+	Unit        string   `json:"u,omitempty"`
+	Value       *float64 `json:"v,omitempty"`
+	StringValue string   `json:"vs,omitempty"`
+	BoolValue   *bool    `json:"vb,omitempty"`
+	Time        float64  `json:"t,omitempty"`
+}
+
+// SenMLCodec encodes and decodes a SenML pack, i.e. a []SenMLRecord.
+type SenMLCodec struct{}
+
+func (SenMLCodec) ContentType() string { return "application/senml+json" }
+
+func (SenMLCodec) Encode(v interface{}) ([]byte, error) {
+	records, ok := v.([]SenMLRecord)
+	if !ok {
+		return nil, fmt.Errorf("cfmessagebus: SenMLCodec requires []SenMLRecord, got %T", v)
+	}
+
+	return json.Marshal(records)
+}
+
+func (SenMLCodec) Decode(data []byte, v interface{}) error {
+	records, ok := v.(*[]SenMLRecord)
+	if !ok {
+		return fmt.Errorf("cfmessagebus: SenMLCodec requires *[]SenMLRecord, got %T", v)
+	}
+
+	return json.Unmarshal(data, records)
+}
+
+// newCorrelationID generates the CorrelationID carried by an Envelope.
+func newCorrelationID() (string, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+
+	return id.String(), nil
+}
@@ -0,0 +1,267 @@
+package cfmessagebus
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// fakeNatsServer is a minimal, in-process stand-in for a NATS server: just
+// enough of the text protocol (CONNECT/PING/SUB/UNSUB/PUB, replying with
+// +OK/PONG and fanning PUB out to matching SUBs as MSG) for NatsAdapter's
+// integration tests to exercise real wire traffic without a gnatsd binary.
+// Queue-grouped subs round-robin; plain subs broadcast.
+type fakeNatsServer struct {
+	ln net.Listener
+
+	mu      sync.Mutex
+	conns   []*fakeNatsConn
+	subs    map[subKey]*fakeNatsSub
+	queueRR map[string]int
+}
+
+// subKey identifies a subscription by the connection that made it plus the
+// subscriber-chosen id from its SUB packet. That id is only unique within
+// one client's connection -- yagnats.Client starts its subscriptionCounter
+// at 1 independently for every connection -- so keying on the id alone
+// would let two different connections' subscriptions collide.
+type subKey struct {
+	conn *fakeNatsConn
+	sid  int64
+}
+
+type fakeNatsConn struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+}
+
+func (c *fakeNatsConn) write(line string) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	io.WriteString(c.conn, line)
+}
+
+type fakeNatsSub struct {
+	conn    *fakeNatsConn
+	sid     int64
+	subject string
+	queue   string
+}
+
+func startFakeNatsServer() (*fakeNatsServer, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	server := &fakeNatsServer{
+		ln:      ln,
+		subs:    map[subKey]*fakeNatsSub{},
+		queueRR: map[string]int{},
+	}
+
+	go server.acceptLoop()
+
+	return server, nil
+}
+
+func (s *fakeNatsServer) addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *fakeNatsServer) host() (string, int) {
+	host, portStr, _ := net.SplitHostPort(s.addr())
+	port, _ := strconv.Atoi(portStr)
+	return host, port
+}
+
+func (s *fakeNatsServer) close() {
+	s.ln.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.conn.Close()
+	}
+}
+
+// dropConnections forcibly closes every connection currently accepted,
+// simulating the server side of an unexpected network drop. Clients
+// notice on their next read or Ping.
+func (s *fakeNatsServer) dropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *fakeNatsServer) acceptLoop() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		fc := &fakeNatsConn{conn: conn}
+
+		s.mu.Lock()
+		s.conns = append(s.conns, fc)
+		s.mu.Unlock()
+
+		fc.write("INFO {}\r\n")
+
+		go s.handleConn(fc)
+	}
+}
+
+func (s *fakeNatsServer) handleConn(fc *fakeNatsConn) {
+	reader := bufio.NewReader(fc.conn)
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			s.removeConn(fc)
+			return
+		}
+
+		fields := strings.Fields(strings.TrimSpace(line))
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch strings.ToUpper(fields[0]) {
+		case "CONNECT":
+			fc.write("+OK\r\n")
+
+		case "PING":
+			fc.write("PONG\r\n")
+
+		case "PONG":
+			// nothing to do
+
+		case "SUB":
+			sid, subject, queue := parseSub(fields)
+			s.mu.Lock()
+			s.subs[subKey{fc, sid}] = &fakeNatsSub{conn: fc, sid: sid, subject: subject, queue: queue}
+			s.mu.Unlock()
+			fc.write("+OK\r\n")
+
+		case "UNSUB":
+			sid, _ := strconv.ParseInt(fields[1], 10, 64)
+			s.mu.Lock()
+			delete(s.subs, subKey{fc, sid})
+			s.mu.Unlock()
+			fc.write("+OK\r\n")
+
+		case "PUB":
+			subject, reply, size := parsePub(fields)
+			payload := make([]byte, size)
+			io.ReadFull(reader, payload)
+			reader.ReadString('\n')
+			fc.write("+OK\r\n")
+			s.deliver(subject, reply, payload)
+
+		default:
+			fc.write(fmt.Sprintf("-ERR 'unknown op %s'\r\n", fields[0]))
+		}
+	}
+}
+
+func (s *fakeNatsServer) removeConn(fc *fakeNatsConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, sub := range s.subs {
+		if sub.conn == fc {
+			delete(s.subs, key)
+		}
+	}
+
+	remaining := s.conns[:0]
+	for _, c := range s.conns {
+		if c != fc {
+			remaining = append(remaining, c)
+		}
+	}
+	s.conns = remaining
+}
+
+func (s *fakeNatsServer) deliver(subject, reply string, payload []byte) {
+	s.mu.Lock()
+
+	byQueue := map[string][]*fakeNatsSub{}
+	var broadcast []*fakeNatsSub
+
+	for _, sub := range s.subs {
+		if sub.subject != subject {
+			continue
+		}
+
+		if sub.queue == "" {
+			broadcast = append(broadcast, sub)
+			continue
+		}
+
+		key := subject + "\x00" + sub.queue
+		byQueue[key] = append(byQueue[key], sub)
+	}
+
+	var picked []*fakeNatsSub
+	picked = append(picked, broadcast...)
+
+	for key, members := range byQueue {
+		// s.subs is a map, so put members in a stable order before the
+		// counter picks one; otherwise the pick would be random.
+		sort.Slice(members, func(i, j int) bool { return members[i].sid < members[j].sid })
+		idx := s.queueRR[key] % len(members)
+		s.queueRR[key] = s.queueRR[key] + 1
+		picked = append(picked, members[idx])
+	}
+
+	s.mu.Unlock()
+
+	for _, sub := range picked {
+		msg := fmt.Sprintf("MSG %s %d %s%d\r\n%s\r\n", subject, sub.sid, replyField(reply), len(payload), payload)
+		sub.conn.write(msg)
+	}
+}
+
+func replyField(reply string) string {
+	if reply == "" {
+		return ""
+	}
+	return reply + " "
+}
+
+func parseSub(fields []string) (sid int64, subject string, queue string) {
+	if len(fields) == 3 {
+		subject = fields[1]
+		sid, _ = strconv.ParseInt(fields[2], 10, 64)
+		return
+	}
+
+	subject = fields[1]
+	queue = fields[2]
+	sid, _ = strconv.ParseInt(fields[3], 10, 64)
+	return
+}
+
+func parsePub(fields []string) (subject string, reply string, size int) {
+	if len(fields) == 3 {
+		subject = fields[1]
+		size, _ = strconv.Atoi(fields[2])
+		return
+	}
+
+	subject = fields[1]
+	reply = fields[2]
+	size, _ = strconv.Atoi(fields[3])
+	return
+}
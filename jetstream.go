@@ -0,0 +1,256 @@
+package cfmessagebus
+
+import (
+	"fmt"
+	"time"
+
+	natsio "github.com/nats-io/nats.go"
+)
+
+// pullFetchWait bounds how long a RespondInQueue worker's Fetch call
+// blocks when the durable consumer has nothing pending, so closing the
+// subscription's done channel makes the worker goroutine notice and
+// exit promptly instead of sitting in a long-lived Fetch.
+const pullFetchWait = 2 * time.Second
+
+// JetStreamAdapter is a MessageBus backed by NATS JetStream. Unlike
+// NatsAdapter it publishes through a stream, so messages survive a
+// disconnect between publisher and subscriber; queue groups are mapped
+// onto a shared durable pull consumer so that a given message is only
+// handed to one member of the group and isn't lost if that member
+// restarts (see RespondInQueue).
+type JetStreamAdapter struct {
+	conn *natsio.Conn
+	js   natsio.JetStreamContext
+
+	host     string
+	port     int
+	user     string
+	password string
+	stream   string
+
+	subscriptions []*jetStreamSubscription
+
+	connectedCallback func()
+	logger            Logger
+}
+
+type jetStreamSubscription struct {
+	subject string
+	queue   string
+	sub     *natsio.Subscription
+	done    chan struct{}
+}
+
+var _ MessageBus = (*JetStreamAdapter)(nil)
+
+func NewJetStreamAdapter() *JetStreamAdapter {
+	return &JetStreamAdapter{}
+}
+
+func (adapter *JetStreamAdapter) Configure(host string, port int, user string, password string) {
+	adapter.host = host
+	adapter.port = port
+	adapter.user = user
+	adapter.password = password
+}
+
+// SetStream names the JetStream stream this adapter publishes to and
+// consumes from. It must be called before Connect.
+func (adapter *JetStreamAdapter) SetStream(stream string) {
+	adapter.stream = stream
+}
+
+func (adapter *JetStreamAdapter) OnConnect(callback func()) {
+	adapter.connectedCallback = callback
+}
+
+func (adapter *JetStreamAdapter) SetLogger(logger Logger) {
+	adapter.logger = logger
+}
+
+func (adapter *JetStreamAdapter) Connect() error {
+	url := fmt.Sprintf("nats://%s:%d", adapter.host, adapter.port)
+
+	opts := []natsio.Option{}
+	if adapter.user != "" {
+		opts = append(opts, natsio.UserInfo(adapter.user, adapter.password))
+	}
+
+	conn, err := natsio.Connect(url, opts...)
+	if err != nil {
+		return err
+	}
+
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	if adapter.stream != "" {
+		_, err = js.AddStream(&natsio.StreamConfig{
+			Name:     adapter.stream,
+			Subjects: []string{adapter.stream + ".>"},
+		})
+		if err != nil && err != natsio.ErrStreamNameAlreadyInUse {
+			conn.Close()
+			return err
+		}
+	}
+
+	adapter.conn = conn
+	adapter.js = js
+
+	if adapter.connectedCallback != nil {
+		adapter.connectedCallback()
+	}
+
+	return nil
+}
+
+func (adapter *JetStreamAdapter) Subscribe(subject string, callback func(payload []byte)) error {
+	return withJetStream(adapter.js, func() error {
+		sub, err := adapter.js.Subscribe(subject, func(msg *natsio.Msg) {
+			callback(msg.Data)
+			msg.Ack()
+		})
+		if err != nil {
+			return err
+		}
+
+		adapter.subscriptions = append(adapter.subscriptions, &jetStreamSubscription{subject: subject, sub: sub})
+		return nil
+	})
+}
+
+func (adapter *JetStreamAdapter) RespondToChannel(subject string, replyCallback func([]byte) []byte) error {
+	return withJetStream(adapter.js, func() error {
+		sub, err := adapter.js.Subscribe(subject, func(msg *natsio.Msg) {
+			reply := replyCallback(msg.Data)
+			if msg.Reply != "" {
+				adapter.conn.Publish(msg.Reply, reply)
+			}
+			msg.Ack()
+		})
+		if err != nil {
+			return err
+		}
+
+		adapter.subscriptions = append(adapter.subscriptions, &jetStreamSubscription{subject: subject, sub: sub})
+		return nil
+	})
+}
+
+// RespondInQueue behaves like RespondToChannel, except every responder
+// that calls it with the same queue binds to one durable JetStream pull
+// consumer named after queue, instead of the ephemeral push consumer
+// Subscribe/RespondToChannel get: the server hands each pending message
+// to whichever bound member next calls Fetch, so the group load-balances
+// the subject between its members, and the consumer's position survives
+// a responder restart because it's durable. A goroutine per call to
+// RespondInQueue drives its own Fetch loop; acking is manual, so a
+// message isn't considered delivered until replyCallback has actually
+// run.
+func (adapter *JetStreamAdapter) RespondInQueue(subject string, queue string, replyCallback func([]byte) []byte) error {
+	return withJetStream(adapter.js, func() error {
+		sub, err := adapter.js.PullSubscribe(subject, queue, natsio.ManualAck())
+		if err != nil {
+			return err
+		}
+
+		done := make(chan struct{})
+		go adapter.pullLoop(sub, done, replyCallback)
+
+		adapter.subscriptions = append(adapter.subscriptions, &jetStreamSubscription{subject: subject, queue: queue, sub: sub, done: done})
+		return nil
+	})
+}
+
+// pullLoop repeatedly fetches one message at a time from sub, a durable
+// pull consumer bound by RespondInQueue, until done is closed. Each
+// fetched message gets replyCallback run on it, its reply published
+// through core NATS, and a manual ack, all before the next Fetch.
+func (adapter *JetStreamAdapter) pullLoop(sub *natsio.Subscription, done chan struct{}, replyCallback func([]byte) []byte) {
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		msgs, err := sub.Fetch(1, natsio.MaxWait(pullFetchWait))
+		if err != nil {
+			continue
+		}
+
+		for _, msg := range msgs {
+			reply := replyCallback(msg.Data)
+			if msg.Reply != "" {
+				adapter.conn.Publish(msg.Reply, reply)
+			}
+			msg.Ack()
+		}
+	}
+}
+
+func (adapter *JetStreamAdapter) UnsubscribeAll() error {
+	return withJetStream(adapter.js, func() error {
+		for _, sub := range adapter.subscriptions {
+			if sub.done != nil {
+				close(sub.done)
+			}
+			sub.sub.Unsubscribe()
+		}
+		adapter.subscriptions = nil
+		return nil
+	})
+}
+
+func (adapter *JetStreamAdapter) Publish(subject string, message []byte) error {
+	return withJetStream(adapter.js, func() error {
+		_, err := adapter.js.Publish(subject, message)
+		return err
+	})
+}
+
+// Request publishes message on subject with a generated reply-to inbox
+// and invokes callback for every reply received on it. The inbox is
+// subscribed through core NATS, not the JetStream context: JetStream
+// would try to resolve a stream for it via StreamNameBySubject, and the
+// only stream this adapter ever creates is scoped to SetStream's prefix,
+// which an _INBOX.<uuid> reply subject never falls under.
+func (adapter *JetStreamAdapter) Request(subject string, message []byte, callback func(payload []byte)) error {
+	return withJetStream(adapter.js, func() error {
+		inbox, err := createInbox()
+		if err != nil {
+			return err
+		}
+
+		sub, err := adapter.conn.Subscribe(inbox, func(msg *natsio.Msg) {
+			callback(msg.Data)
+		})
+		if err != nil {
+			return err
+		}
+		adapter.subscriptions = append(adapter.subscriptions, &jetStreamSubscription{subject: inbox, sub: sub})
+
+		return adapter.conn.PublishRequest(subject, inbox, message)
+	})
+}
+
+func (adapter *JetStreamAdapter) Ping() bool {
+	if adapter.conn == nil {
+		return false
+	}
+
+	return adapter.conn.IsConnected()
+}
+
+func withJetStream(js natsio.JetStreamContext, callback func() error) error {
+	if js == nil {
+		return errNoConnection
+	}
+
+	return callback()
+}
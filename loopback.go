@@ -0,0 +1,200 @@
+package cfmessagebus
+
+import "sync"
+
+// LoopbackAdapter is an in-process MessageBus with no network dependency.
+// It exists mainly so unit tests can exercise code written against
+// MessageBus without standing up a real NATS server. A single dispatcher
+// goroutine delivers published messages to subscribers in FIFO order,
+// across all subjects, in the order Publish was called.
+type LoopbackAdapter struct {
+	mu            sync.Mutex
+	cond          *sync.Cond
+	subscriptions []*Subscription
+	nextID        int64
+	connected     bool
+	inFlight      int
+	pending       chan loopbackMessage
+	done          chan struct{}
+
+	connectedCallback func()
+	logger            Logger
+}
+
+type loopbackMessage struct {
+	subject string
+	payload []byte
+	replyTo string
+}
+
+var _ MessageBus = (*LoopbackAdapter)(nil)
+
+func NewLoopbackAdapter() *LoopbackAdapter {
+	adapter := &LoopbackAdapter{
+		pending: make(chan loopbackMessage, 64),
+		done:    make(chan struct{}),
+	}
+	adapter.cond = sync.NewCond(&adapter.mu)
+
+	return adapter
+}
+
+// Configure is a no-op for the loopback bus; it has no remote endpoint to
+// dial. It is present so LoopbackAdapter satisfies MessageBus.
+func (adapter *LoopbackAdapter) Configure(host string, port int, user string, password string) {
+}
+
+func (adapter *LoopbackAdapter) Connect() error {
+	adapter.mu.Lock()
+	adapter.connected = true
+	adapter.mu.Unlock()
+
+	go adapter.dispatchLoop()
+
+	if adapter.connectedCallback != nil {
+		adapter.connectedCallback()
+	}
+
+	return nil
+}
+
+func (adapter *LoopbackAdapter) OnConnect(callback func()) {
+	adapter.connectedCallback = callback
+}
+
+func (adapter *LoopbackAdapter) SetLogger(logger Logger) {
+	adapter.logger = logger
+}
+
+func (adapter *LoopbackAdapter) Subscribe(subject string, callback func(payload []byte)) error {
+	adapter.mu.Lock()
+	defer adapter.mu.Unlock()
+
+	adapter.nextID++
+	adapter.subscriptions = append(adapter.subscriptions, &Subscription{
+		subject:  subject,
+		callback: callback,
+		id:       adapter.nextID,
+	})
+
+	return nil
+}
+
+func (adapter *LoopbackAdapter) RespondToChannel(subject string, replyCallback func([]byte) []byte) error {
+	adapter.mu.Lock()
+	defer adapter.mu.Unlock()
+
+	adapter.nextID++
+	adapter.subscriptions = append(adapter.subscriptions, &Subscription{
+		subject: subject,
+		reply:   replyCallback,
+		id:      adapter.nextID,
+	})
+
+	return nil
+}
+
+func (adapter *LoopbackAdapter) UnsubscribeAll() error {
+	adapter.mu.Lock()
+	defer adapter.mu.Unlock()
+
+	adapter.subscriptions = []*Subscription{}
+	return nil
+}
+
+func (adapter *LoopbackAdapter) Publish(subject string, message []byte) error {
+	return adapter.publish(subject, message, "")
+}
+
+func (adapter *LoopbackAdapter) publish(subject string, message []byte, replyTo string) error {
+	adapter.mu.Lock()
+	connected := adapter.connected
+	if connected {
+		// Counted before it is queued, so waitForSubscriptionsEmpty cannot
+		// see an empty queue while this message is between the channel
+		// and deliver.
+		adapter.inFlight++
+	}
+	adapter.mu.Unlock()
+
+	if !connected {
+		return errNoConnection
+	}
+
+	adapter.pending <- loopbackMessage{subject: subject, payload: message, replyTo: replyTo}
+	return nil
+}
+
+func (adapter *LoopbackAdapter) Request(subject string, message []byte, callback func(payload []byte)) error {
+	inbox, err := createInbox()
+	if err != nil {
+		return err
+	}
+
+	adapter.Subscribe(inbox, callback)
+	return adapter.publish(subject, message, inbox)
+}
+
+func (adapter *LoopbackAdapter) Ping() bool {
+	adapter.mu.Lock()
+	defer adapter.mu.Unlock()
+	return adapter.connected
+}
+
+// dispatchLoop is the single goroutine per client that hands published
+// messages to subscribers. Reading pending in a loop, rather than
+// spawning a goroutine per Publish, is what keeps delivery order FIFO
+// across subjects.
+func (adapter *LoopbackAdapter) dispatchLoop() {
+	for {
+		select {
+		case msg := <-adapter.pending:
+			adapter.deliver(msg)
+
+			adapter.mu.Lock()
+			adapter.inFlight--
+			if adapter.inFlight == 0 && len(adapter.pending) == 0 {
+				adapter.cond.Broadcast()
+			}
+			adapter.mu.Unlock()
+		case <-adapter.done:
+			return
+		}
+	}
+}
+
+func (adapter *LoopbackAdapter) deliver(msg loopbackMessage) {
+	adapter.mu.Lock()
+	matching := make([]*Subscription, 0, len(adapter.subscriptions))
+	for _, sub := range adapter.subscriptions {
+		if sub.subject == msg.subject {
+			matching = append(matching, sub)
+		}
+	}
+	adapter.mu.Unlock()
+
+	for _, sub := range matching {
+		if sub.reply != nil {
+			if msg.replyTo == "" {
+				continue
+			}
+			adapter.publish(msg.replyTo, sub.reply(msg.payload), "")
+		} else {
+			sub.callback(msg.payload)
+		}
+	}
+}
+
+// waitForSubscriptionsEmpty blocks until there are no messages left
+// waiting to be dispatched and deliver has returned for the last one
+// dequeued. Tests use this to make sure every Publish has been fully
+// delivered, including its subscriber callbacks, before asserting on its
+// effects.
+func (adapter *LoopbackAdapter) waitForSubscriptionsEmpty() {
+	adapter.mu.Lock()
+	defer adapter.mu.Unlock()
+
+	for adapter.inFlight > 0 || len(adapter.pending) > 0 {
+		adapter.cond.Wait()
+	}
+}
@@ -0,0 +1,90 @@
+package cfmessagebus
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoopbackAdapterPublishSubscribe(t *testing.T) {
+	bus := NewLoopbackAdapter()
+	if err := bus.Connect(); err != nil {
+		t.Fatalf("Connect: %s", err)
+	}
+
+	var mu sync.Mutex
+	var received []byte
+
+	bus.Subscribe("foo", func(payload []byte) {
+		mu.Lock()
+		received = payload
+		mu.Unlock()
+	})
+
+	if err := bus.Publish("foo", []byte("bar")); err != nil {
+		t.Fatalf("Publish: %s", err)
+	}
+
+	bus.waitForSubscriptionsEmpty()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if string(received) != "bar" {
+		t.Fatalf("expected subscriber to receive %q, got %q", "bar", received)
+	}
+}
+
+func TestLoopbackAdapterRequest(t *testing.T) {
+	bus := NewLoopbackAdapter()
+	if err := bus.Connect(); err != nil {
+		t.Fatalf("Connect: %s", err)
+	}
+
+	bus.RespondToChannel("echo", func(payload []byte) []byte {
+		return payload
+	})
+
+	replies := make(chan []byte, 1)
+	if err := bus.Request("echo", []byte("ping"), func(payload []byte) {
+		replies <- payload
+	}); err != nil {
+		t.Fatalf("Request: %s", err)
+	}
+
+	select {
+	case reply := <-replies:
+		if string(reply) != "ping" {
+			t.Fatalf("expected reply %q, got %q", "ping", reply)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for reply")
+	}
+}
+
+func TestLoopbackAdapterWaitForSubscriptionsEmptyWaitsForDeliveryToFinish(t *testing.T) {
+	bus := NewLoopbackAdapter()
+	if err := bus.Connect(); err != nil {
+		t.Fatalf("Connect: %s", err)
+	}
+
+	var delivered bool
+	bus.Subscribe("slow", func(payload []byte) {
+		time.Sleep(20 * time.Millisecond)
+		delivered = true
+	})
+
+	bus.Publish("slow", []byte("x"))
+	bus.waitForSubscriptionsEmpty()
+
+	if !delivered {
+		t.Fatal("expected waitForSubscriptionsEmpty to block until the subscriber callback ran")
+	}
+}
+
+func TestLoopbackAdapterPublishBeforeConnectFails(t *testing.T) {
+	bus := NewLoopbackAdapter()
+
+	if err := bus.Publish("foo", []byte("bar")); err == nil {
+		t.Fatal("expected Publish before Connect to fail")
+	}
+}
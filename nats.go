@@ -1,34 +1,67 @@
 package cfmessagebus
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	nats "github.com/cloudfoundry/yagnats"
-	"github.com/nu7hatch/gouuid"
 	"math/rand"
+	"reflect"
+	"sync"
 	"time"
 )
 
+// ServerInfo describes one member of a NATS cluster, as passed to
+// ConfigureCluster.
+type ServerInfo struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+}
+
+// disconnectPollInterval is how often watchForDisconnect checks whether
+// the connection is still up. yagnats.Client reconnects and resubscribes
+// on its own and has no hook of its own for observing a drop, so this
+// polling is what OnDisconnect is built on.
+const disconnectPollInterval = 1 * time.Second
+
+var errConnectionLost = errors.New("connection to Nats lost")
+
 type NatsAdapter struct {
+	mu            sync.Mutex
 	client        *nats.Client
-	host          string
-	user          string
-	port          int
-	password      string
 	subscriptions []*Subscription
-	rand          *rand.Rand
 
-	connectedCallback func()
-	logger            Logger
+	host     string
+	user     string
+	port     int
+	password string
+	members  []ServerInfo
+	rand     *rand.Rand
+
+	codec Codec
+
+	connectedCallback    func()
+	disconnectedCallback func(error)
+	decodeErrorCallback  func(subject string, err error)
+	peerLostCallback     func(subject string)
+	logger               Logger
 }
 
+const heartbeatSuffix = ".hb"
+
 type Subscription struct {
-	subject  string
-	callback func([]byte)
-	reply    func([]byte) []byte
-	id       int
+	subject    string
+	queue      string
+	callback   func([]byte)
+	reply      func([]byte) []byte
+	rawHandler func(*nats.Message)
+	id         int64
 }
 
+var _ MessageBus = (*NatsAdapter)(nil)
+
 func NewNatsAdapter() *NatsAdapter {
 	return &NatsAdapter{}
 }
@@ -40,6 +73,14 @@ func (adapter *NatsAdapter) Configure(host string, port int, user string, passwo
 	adapter.password = password
 }
 
+// ConfigureCluster replaces the single-server configuration set by
+// Configure with a list of candidate servers. Connect (and every
+// reconnect attempt afterwards) tries them in randomized order and
+// stops at the first one that accepts the connection.
+func (adapter *NatsAdapter) ConfigureCluster(members []ServerInfo) {
+	adapter.members = members
+}
+
 func (adapter *NatsAdapter) Connect() error {
 	return adapter.connect()
 }
@@ -48,12 +89,186 @@ func (adapter *NatsAdapter) OnConnect(callback func()) {
 	adapter.connectedCallback = callback
 }
 
+// OnDisconnect registers a callback that is invoked, with the error that
+// caused the drop, whenever the connection to the cluster is lost. The
+// drop is noticed by watchForDisconnect's poll, every
+// disconnectPollInterval, and the callback fires once per transition from
+// up to down that a poll sees. The adapter runs no reconnect loop of its
+// own: the yagnats client reconnects by itself, so a drop that it repairs
+// between two polls is not reported.
+func (adapter *NatsAdapter) OnDisconnect(callback func(error)) {
+	adapter.mu.Lock()
+	adapter.disconnectedCallback = callback
+	adapter.mu.Unlock()
+}
+
+// getDisconnectedCallback returns the callback registered by OnDisconnect
+// under lock, since watchForDisconnect runs on its own goroutine and
+// OnDisconnect can be called after Connect.
+func (adapter *NatsAdapter) getDisconnectedCallback() func(error) {
+	adapter.mu.Lock()
+	defer adapter.mu.Unlock()
+
+	return adapter.disconnectedCallback
+}
+
 func (adapter *NatsAdapter) SetLogger(logger Logger) {
 	adapter.logger = logger
 }
 
+// SetCodec changes the bus-wide default Codec used by PublishTyped and
+// SubscribeTyped. It defaults to JSONCodec.
+func (adapter *NatsAdapter) SetCodec(codec Codec) {
+	adapter.codec = codec
+}
+
+func (adapter *NatsAdapter) defaultCodec() Codec {
+	if adapter.codec != nil {
+		return adapter.codec
+	}
+
+	return JSONCodec{}
+}
+
+// OnDecodeError registers a callback invoked whenever SubscribeTyped
+// fails to decode a message, instead of silently dropping it.
+func (adapter *NatsAdapter) OnDecodeError(callback func(subject string, err error)) {
+	adapter.decodeErrorCallback = callback
+}
+
+func (adapter *NatsAdapter) decodeError(subject string, err error) {
+	if adapter.decodeErrorCallback != nil {
+		adapter.decodeErrorCallback(subject, err)
+	}
+}
+
+// PublishTyped wraps v in an Envelope, encoded with the bus-wide default
+// codec, and publishes it on subject.
+func (adapter *NatsAdapter) PublishTyped(subject string, v interface{}) error {
+	return adapter.PublishTypedWithCodec(subject, v, adapter.defaultCodec())
+}
+
+// PublishTypedWithCodec behaves like PublishTyped, but encodes v with
+// codec instead of the bus-wide default.
+func (adapter *NatsAdapter) PublishTypedWithCodec(subject string, v interface{}, codec Codec) error {
+	payload, err := codec.Encode(v)
+	if err != nil {
+		return err
+	}
+
+	correlationID, err := newCorrelationID()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(Envelope{
+		Subject:       subject,
+		Payload:       payload,
+		ContentType:   codec.ContentType(),
+		CorrelationID: correlationID,
+		Timestamp:     time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	return adapter.Publish(subject, data)
+}
+
+// SubscribeTyped subscribes to subject and decodes every message into a
+// newly allocated *T, where T is prototype's type with any pointer
+// indirection removed, using the bus-wide default codec, before handing
+// that pointer to cb. Decode failures go to OnDecodeError
+// rather than to cb.
+func (adapter *NatsAdapter) SubscribeTyped(subject string, prototype interface{}, cb func(v interface{})) error {
+	return adapter.SubscribeTypedWithCodec(subject, prototype, adapter.defaultCodec(), cb)
+}
+
+// SubscribeTypedWithCodec behaves like SubscribeTyped, but decodes with
+// codec instead of the bus-wide default.
+func (adapter *NatsAdapter) SubscribeTypedWithCodec(subject string, prototype interface{}, codec Codec, cb func(v interface{})) error {
+	elemType := reflect.TypeOf(prototype)
+	if elemType == nil {
+		return errors.New("SubscribeTypedWithCodec: prototype must not be nil")
+	}
+	for elemType.Kind() == reflect.Ptr {
+		elemType = elemType.Elem()
+	}
+
+	return adapter.Subscribe(subject, func(payload []byte) {
+		var envelope Envelope
+		if err := json.Unmarshal(payload, &envelope); err != nil {
+			adapter.decodeError(subject, err)
+			return
+		}
+
+		v := reflect.New(elemType).Interface()
+		if err := codec.Decode(envelope.Payload, v); err != nil {
+			adapter.decodeError(subject, err)
+			return
+		}
+
+		cb(v)
+	})
+}
+
+// clusterMembers returns the configured cluster, falling back to the
+// single host/port set via Configure when ConfigureCluster was never
+// called.
+func (adapter *NatsAdapter) clusterMembers() []ServerInfo {
+	if len(adapter.members) > 0 {
+		return adapter.members
+	}
+
+	return []ServerInfo{{Host: adapter.host, Port: adapter.port, User: adapter.user, Password: adapter.password}}
+}
+
+// shuffledMembers returns the cluster in randomized order so that, e.g.,
+// every replica of a CF component doesn't pile onto the same server
+// first.
+func (adapter *NatsAdapter) shuffledMembers() []ServerInfo {
+	members := adapter.clusterMembers()
+	shuffled := make([]ServerInfo, len(members))
+	copy(shuffled, members)
+
+	adapter.rand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+
+	return shuffled
+}
+
+// connectionProvider builds the yagnats.ConnectionProvider passed to
+// Client.Connect: a single ConnectionInfo for one server, or a
+// ConnectionCluster of them when ConfigureCluster was used. The client
+// itself retries every member of the ConnectionCluster, with its own
+// reconnect loop, so the adapter doesn't need one of its own.
+func (adapter *NatsAdapter) connectionProvider() nats.ConnectionProvider {
+	members := adapter.shuffledMembers()
+	if len(members) == 1 {
+		return connectionInfo(members[0])
+	}
+
+	providers := make([]nats.ConnectionProvider, len(members))
+	for i, member := range members {
+		providers[i] = connectionInfo(member)
+	}
+
+	return &nats.ConnectionCluster{Members: providers}
+}
+
+func connectionInfo(member ServerInfo) *nats.ConnectionInfo {
+	return &nats.ConnectionInfo{
+		Addr:     fmt.Sprintf("%s:%d", member.Host, member.Port),
+		Username: member.User,
+		Password: member.Password,
+	}
+}
+
 func (adapter *NatsAdapter) connect() error {
-	addr := fmt.Sprintf("%s:%d", adapter.host, adapter.port)
+	if adapter.rand == nil {
+		adapter.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
 
 	client := nats.NewClient()
 
@@ -64,124 +279,507 @@ func (adapter *NatsAdapter) connect() error {
 	}
 
 	if adapter.logger != nil {
-		client.Logger = adapter.logger
+		client.SetLogger(&yagnatsLoggerShim{adapter.logger})
 	}
 
-	err := client.Connect(&nats.ConnectionInfo{
-		Addr:     addr,
-		Username: adapter.user,
-		Password: adapter.password,
-	})
-
-	if err != nil {
+	if err := client.Connect(adapter.connectionProvider()); err != nil {
 		return err
 	}
 
-	adapter.client = client
-	adapter.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	adapter.setClient(client)
 
-	for _, sub := range adapter.subscriptions {
-		subscribeInNats(adapter, sub)
+	go adapter.watchForDisconnect(client)
+
+	for _, sub := range adapter.cachedSubscriptions() {
+		subscribeInNats(client, adapter, sub)
 	}
 
 	return nil
 }
 
-func (adapter *NatsAdapter) createInbox() (string, error) {
-	uuid, err := uuid.NewV4()
-	if err != nil {
-		return "", err
+// watchForDisconnect polls client's liveness and reports drops via
+// OnDisconnect. yagnats.Client reconnects and resubscribes by itself and
+// exposes no disconnect hook, so polling is the only way to observe a
+// drop from outside the client. It stops once adapter.client no longer
+// points at client, i.e. Connect was called again.
+func (adapter *NatsAdapter) watchForDisconnect(client *nats.Client) {
+	up := true
+
+	for adapter.getClient() == client {
+		time.Sleep(disconnectPollInterval)
+
+		nowUp := client.Ping()
+		if up && !nowUp {
+			if callback := adapter.getDisconnectedCallback(); callback != nil {
+				callback(errConnectionLost)
+			}
+		}
+		up = nowUp
 	}
+}
 
-	return fmt.Sprintf("_INBOX.%s", uuid), nil
+// yagnatsLoggerShim adapts this package's Logger (printf-style) to the
+// positional, structured Logger the yagnats client expects.
+type yagnatsLoggerShim struct {
+	logger Logger
+}
+
+func (s *yagnatsLoggerShim) Fatal(msg string) { s.logger.Errorf("%s", msg) }
+func (s *yagnatsLoggerShim) Error(msg string) { s.logger.Errorf("%s", msg) }
+func (s *yagnatsLoggerShim) Warn(msg string)  { s.logger.Warnf("%s", msg) }
+func (s *yagnatsLoggerShim) Info(msg string)  { s.logger.Infof("%s", msg) }
+func (s *yagnatsLoggerShim) Debug(msg string) { s.logger.Debugf("%s", msg) }
+
+func (s *yagnatsLoggerShim) Fatald(data map[string]interface{}, msg string) {
+	s.logger.Errorf("%s %+v", msg, data)
+}
+func (s *yagnatsLoggerShim) Errord(data map[string]interface{}, msg string) {
+	s.logger.Errorf("%s %+v", msg, data)
+}
+func (s *yagnatsLoggerShim) Warnd(data map[string]interface{}, msg string) {
+	s.logger.Warnf("%s %+v", msg, data)
+}
+func (s *yagnatsLoggerShim) Infod(data map[string]interface{}, msg string) {
+	s.logger.Infof("%s %+v", msg, data)
+}
+func (s *yagnatsLoggerShim) Debugd(data map[string]interface{}, msg string) {
+	s.logger.Debugf("%s %+v", msg, data)
+}
+
+// getClient returns the current client pointer under lock.
+func (adapter *NatsAdapter) getClient() *nats.Client {
+	adapter.mu.Lock()
+	defer adapter.mu.Unlock()
+
+	return adapter.client
+}
+
+func (adapter *NatsAdapter) setClient(client *nats.Client) {
+	adapter.mu.Lock()
+	adapter.client = client
+	adapter.mu.Unlock()
+}
+
+// cacheSubscription records sub so it can be replayed once Connect
+// succeeds, and so UnsubscribeAll/unsubscribeInbox can find it again.
+func (adapter *NatsAdapter) cacheSubscription(sub *Subscription) {
+	adapter.mu.Lock()
+	adapter.subscriptions = append(adapter.subscriptions, sub)
+	adapter.mu.Unlock()
+}
+
+// cachedSubscriptions returns a snapshot of the cached subscriptions,
+// safe to range over without holding adapter.mu.
+func (adapter *NatsAdapter) cachedSubscriptions() []*Subscription {
+	adapter.mu.Lock()
+	defer adapter.mu.Unlock()
+
+	subs := make([]*Subscription, len(adapter.subscriptions))
+	copy(subs, adapter.subscriptions)
+
+	return subs
+}
+
+func (adapter *NatsAdapter) clearSubscriptions() {
+	adapter.mu.Lock()
+	adapter.subscriptions = nil
+	adapter.mu.Unlock()
+}
+
+func (adapter *NatsAdapter) createInbox() (string, error) {
+	return createInbox()
 }
 
 func (adapter *NatsAdapter) Subscribe(subject string, callback func(payload []byte)) error {
 	sub := &Subscription{subject: subject, callback: callback}
-	adapter.subscriptions = append(adapter.subscriptions, sub)
+	adapter.cacheSubscription(sub)
 
-	if adapter.client != nil {
-		subscribeInNats(adapter, sub)
-	} else {
+	client := adapter.getClient()
+	if client == nil {
+		return errors.New("No connection to Nats. Caching subscription...")
+	}
+
+	subscribeInNats(client, adapter, sub)
+	return nil
+}
+
+// SubscribeWithQueue behaves like Subscribe, except it joins the named
+// queue group: NATS load-balances deliveries for subject across every
+// subscriber in the group instead of broadcasting to all of them, so a
+// rolling restart or scaled-out replica set doesn't have to dedupe.
+func (adapter *NatsAdapter) SubscribeWithQueue(subject string, queue string, callback func(payload []byte)) error {
+	sub := &Subscription{subject: subject, queue: queue, callback: callback}
+	adapter.cacheSubscription(sub)
+
+	client := adapter.getClient()
+	if client == nil {
 		return errors.New("No connection to Nats. Caching subscription...")
 	}
 
+	subscribeInNats(client, adapter, sub)
 	return nil
 }
 
 func (adapter *NatsAdapter) UnsubscribeAll() error {
-	return withConnectionCheck(adapter.client, func() error {
-		for _, sub := range adapter.subscriptions {
-			adapter.client.UnsubscribeAll(sub.subject)
-		}
-		adapter.subscriptions = []*Subscription{}
-		return nil
-	})
+	client := adapter.getClient()
+	if client == nil {
+		return errNoConnection
+	}
+
+	for _, sub := range adapter.cachedSubscriptions() {
+		client.UnsubscribeAll(sub.subject)
+	}
+	adapter.clearSubscriptions()
+
+	return nil
 }
 
 func (adapter *NatsAdapter) Publish(subject string, message []byte) error {
-	return withConnectionCheck(adapter.client, func() error {
-		return adapter.client.Publish(subject, message)
-	})
+	client := adapter.getClient()
+	if client == nil {
+		return errNoConnection
+	}
+
+	return client.Publish(subject, message)
 }
 
+// Request publishes message on subject with a generated reply-to inbox
+// and invokes callback for every reply received on it. The inbox
+// subscription is never torn down, so every reply the responder ever
+// sends on it keeps arriving; prefer RequestWithTimeout or RequestMany,
+// which clean up the inbox once they're done with it.
 func (adapter *NatsAdapter) Request(subject string, message []byte, callback func(payload []byte)) error {
-	return withConnectionCheck(adapter.client, func() error {
-		inbox, err := adapter.createInbox()
-		if err != nil {
-			return err
+	client := adapter.getClient()
+	if client == nil {
+		return errNoConnection
+	}
+
+	inbox, err := adapter.createInbox()
+	if err != nil {
+		return err
+	}
+
+	adapter.Subscribe(inbox, callback)
+	return client.PublishWithReplyTo(subject, inbox, message)
+}
+
+// RequestWithTimeout behaves like Request, except the inbox it creates
+// is unsubscribed and dropped from adapter.subscriptions as soon as the
+// first reply arrives, or after timeout if none does.
+func (adapter *NatsAdapter) RequestWithTimeout(subject string, message []byte, timeout time.Duration, cb func([]byte)) error {
+	client := adapter.getClient()
+	if client == nil {
+		return errNoConnection
+	}
+
+	inbox, err := adapter.createInbox()
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	var once sync.Once
+
+	adapter.Subscribe(inbox, func(payload []byte) {
+		once.Do(func() {
+			cb(payload)
+			close(done)
+		})
+	})
+
+	if err := client.PublishWithReplyTo(subject, inbox, message); err != nil {
+		adapter.unsubscribeInbox(inbox)
+		return err
+	}
+
+	go func() {
+		select {
+		case <-done:
+		case <-time.After(timeout):
 		}
+		adapter.unsubscribeInbox(inbox)
+	}()
 
-		adapter.Subscribe(inbox, callback)
-		return adapter.client.PublishWithReplyTo(subject, inbox, message)
+	return nil
+}
+
+// RequestMany is like RequestWithTimeout, but keeps the inbox alive
+// until either maxReplies replies have been delivered to cb or timeout
+// elapses, whichever comes first. It is meant for fan-in, service
+// discovery style requests where more than one responder may answer.
+func (adapter *NatsAdapter) RequestMany(subject string, message []byte, timeout time.Duration, maxReplies int, cb func([]byte)) error {
+	client := adapter.getClient()
+	if client == nil {
+		return errNoConnection
+	}
+
+	inbox, err := adapter.createInbox()
+	if err != nil {
+		return err
+	}
+
+	var mu sync.Mutex
+	received := 0
+	done := make(chan struct{})
+	var closeOnce sync.Once
+
+	adapter.Subscribe(inbox, func(payload []byte) {
+		mu.Lock()
+		if received >= maxReplies {
+			mu.Unlock()
+			return
+		}
+		received++
+		reachedMax := received >= maxReplies
+		mu.Unlock()
+
+		cb(payload)
+
+		if reachedMax {
+			closeOnce.Do(func() { close(done) })
+		}
 	})
+
+	if err := client.PublishWithReplyTo(subject, inbox, message); err != nil {
+		adapter.unsubscribeInbox(inbox)
+		return err
+	}
+
+	go func() {
+		select {
+		case <-done:
+		case <-time.After(timeout):
+		}
+		adapter.unsubscribeInbox(inbox)
+	}()
+
+	return nil
+}
+
+// unsubscribeInbox tears down a RequestWithTimeout/RequestMany/
+// RequestWithHeartbeat inbox: it unsubscribes it from NATS and drops it from
+// adapter.subscriptions so it isn't re-subscribed on the next reconnect.
+func (adapter *NatsAdapter) unsubscribeInbox(inbox string) {
+	if client := adapter.getClient(); client != nil {
+		client.UnsubscribeAll(inbox)
+	}
+
+	adapter.mu.Lock()
+	defer adapter.mu.Unlock()
+
+	remaining := adapter.subscriptions[:0]
+	for _, sub := range adapter.subscriptions {
+		if sub.subject != inbox {
+			remaining = append(remaining, sub)
+		}
+	}
+	adapter.subscriptions = remaining
+}
+
+// RequestWithHeartbeat behaves like RequestWithTimeout, but also
+// subscribes to the heartbeat inbox a RespondToChannelWithHeartbeat
+// responder publishes keepalives to. If neither a heartbeat nor the
+// final reply arrives within deadline of the last one seen, OnPeerLost
+// fires with subject and both inboxes are torn down.
+func (adapter *NatsAdapter) RequestWithHeartbeat(subject string, message []byte, deadline time.Duration, cb func([]byte)) error {
+	client := adapter.getClient()
+	if client == nil {
+		return errNoConnection
+	}
+
+	inbox, err := adapter.createInbox()
+	if err != nil {
+		return err
+	}
+	heartbeatInbox := inbox + heartbeatSuffix
+
+	seen := make(chan struct{}, 1)
+	done := make(chan struct{})
+	var once sync.Once
+
+	teardown := func() {
+		once.Do(func() {
+			close(done)
+			adapter.unsubscribeInbox(inbox)
+			adapter.unsubscribeInbox(heartbeatInbox)
+		})
+	}
+
+	adapter.Subscribe(heartbeatInbox, func(payload []byte) {
+		select {
+		case seen <- struct{}{}:
+		default:
+		}
+	})
+
+	adapter.Subscribe(inbox, func(payload []byte) {
+		cb(payload)
+		teardown()
+	})
+
+	if err := client.PublishWithReplyTo(subject, inbox, message); err != nil {
+		teardown()
+		return err
+	}
+
+	go func() {
+		for {
+			timer := time.NewTimer(deadline)
+			select {
+			case <-seen:
+				timer.Stop()
+			case <-timer.C:
+				if adapter.peerLostCallback != nil {
+					adapter.peerLostCallback(subject)
+				}
+				teardown()
+				return
+			case <-done:
+				timer.Stop()
+				return
+			}
+		}
+	}()
+
+	return nil
 }
 
 func (adapter *NatsAdapter) RespondToChannel(subject string, replyCallback func([]byte) []byte) error {
 	sub := &Subscription{subject: subject, reply: replyCallback}
-	adapter.subscriptions = append(adapter.subscriptions, sub)
+	adapter.cacheSubscription(sub)
 
-	if adapter.client != nil {
-		subscribeInNats(adapter, sub)
-	} else {
+	client := adapter.getClient()
+	if client == nil {
 		return errors.New("No connection to Nats. Caching subscription...")
 	}
 
+	subscribeInNats(client, adapter, sub)
 	return nil
 }
 
-func (adapter *NatsAdapter) Ping() bool {
-	if adapter.client == nil {
-		return false
-	} else {
-		return adapter.client.Ping()
+// RespondInQueue behaves like RespondToChannel, except it joins the
+// named queue group, so only one member of the group answers any given
+// request instead of every replica responding to it.
+func (adapter *NatsAdapter) RespondInQueue(subject string, queue string, replyCallback func([]byte) []byte) error {
+	sub := &Subscription{subject: subject, queue: queue, reply: replyCallback}
+	adapter.cacheSubscription(sub)
+
+	client := adapter.getClient()
+	if client == nil {
+		return errors.New("No connection to Nats. Caching subscription...")
+	}
+
+	subscribeInNats(client, adapter, sub)
+	return nil
+}
+
+// OnPeerLost registers a callback invoked by RequestWithHeartbeat when it
+// stops seeing heartbeats from a RespondToChannelWithHeartbeat responder
+// within the requester's deadline.
+func (adapter *NatsAdapter) OnPeerLost(callback func(subject string)) {
+	adapter.peerLostCallback = callback
+}
+
+// RespondToChannelWithHeartbeat behaves like RespondToChannel, except
+// while reply is running it publishes a keepalive on the requester's
+// per-session heartbeat inbox (the request's reply-to subject plus
+// heartbeatSuffix) every heartbeatInterval, so the requester can tell
+// the responder is still alive without polling Ping(). reply always
+// runs to completion regardless of deadline; deadline only bounds how
+// long keepalives keep going, as a safety valve against a handler that
+// never returns -- pass 0 for no cap. Pair it with RequestWithHeartbeat
+// on the requester side.
+func (adapter *NatsAdapter) RespondToChannelWithHeartbeat(subject string, heartbeatInterval time.Duration, deadline time.Duration, reply func([]byte) []byte) error {
+	sub := &Subscription{subject: subject}
+	sub.rawHandler = func(msg *nats.Message) {
+		if msg.ReplyTo == "" {
+			return
+		}
+
+		heartbeatInbox := msg.ReplyTo + heartbeatSuffix
+		stop := make(chan struct{})
+
+		if heartbeatInterval > 0 {
+			go func() {
+				ticker := time.NewTicker(heartbeatInterval)
+				defer ticker.Stop()
+
+				var capC <-chan time.Time
+				if deadline > 0 {
+					cap := time.NewTimer(deadline)
+					defer cap.Stop()
+					capC = cap.C
+				}
+
+				for {
+					select {
+					case <-ticker.C:
+						if client := adapter.getClient(); client != nil {
+							client.Publish(heartbeatInbox, []byte("heartbeat"))
+						}
+					case <-capC:
+						return
+					case <-stop:
+						return
+					}
+				}
+			}()
+		}
+
+		result := reply(msg.Payload)
+		close(stop)
+
+		if client := adapter.getClient(); client != nil {
+			client.Publish(msg.ReplyTo, result)
+		}
 	}
+
+	adapter.cacheSubscription(sub)
+
+	client := adapter.getClient()
+	if client == nil {
+		return errors.New("No connection to Nats. Caching subscription...")
+	}
+
+	subscribeInNats(client, adapter, sub)
+	return nil
 }
 
-func withConnectionCheck(connection *nats.Client, callback func() error) error {
-	if connection == nil {
-		return errors.New("No connection to Nats")
+func (adapter *NatsAdapter) Ping() bool {
+	client := adapter.getClient()
+	if client == nil {
+		return false
 	}
 
-	return callback()
+	return client.Ping()
 }
 
-func subscribeInNats(adapter *NatsAdapter, sub *Subscription) {
-	sid, _ := adapter.client.Subscribe(sub.subject, func(msg *nats.Message) {
-		if sub.reply != nil {
-			adapter.replyToMessage(msg, sub.reply)
-		} else {
-			sub.callback([]byte(msg.Payload))
+func subscribeInNats(client *nats.Client, adapter *NatsAdapter, sub *Subscription) {
+	handler := sub.rawHandler
+	if handler == nil {
+		handler = func(msg *nats.Message) {
+			if sub.reply != nil {
+				adapter.replyToMessage(client, msg, sub.reply)
+			} else {
+				sub.callback([]byte(msg.Payload))
+			}
 		}
-	})
+	}
+
+	var sid int64
+	if sub.queue != "" {
+		sid, _ = client.SubscribeWithQueue(sub.subject, sub.queue, handler)
+	} else {
+		sid, _ = client.Subscribe(sub.subject, handler)
+	}
 
 	sub.id = sid
 }
 
-func (a *NatsAdapter) replyToMessage(msg *nats.Message, callback func([]byte) []byte) {
+func (a *NatsAdapter) replyToMessage(client *nats.Client, msg *nats.Message, callback func([]byte) []byte) {
 	if msg.ReplyTo == "" {
 		return
 	}
 
-	a.client.Publish(msg.ReplyTo, callback([]byte(msg.Payload)))
+	client.Publish(msg.ReplyTo, callback([]byte(msg.Payload)))
 }
@@ -0,0 +1,248 @@
+package cfmessagebus
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func connectAdapter(t *testing.T, server *fakeNatsServer) *NatsAdapter {
+	t.Helper()
+
+	host, port := server.host()
+	adapter := NewNatsAdapter()
+	adapter.Configure(host, port, "", "")
+
+	if err := adapter.Connect(); err != nil {
+		t.Fatalf("Connect: %s", err)
+	}
+
+	return adapter
+}
+
+func TestNatsAdapterConfigureClusterFailsOverToSecondMember(t *testing.T) {
+	server, err := startFakeNatsServer()
+	if err != nil {
+		t.Fatalf("startFakeNatsServer: %s", err)
+	}
+	defer server.close()
+
+	deadListener, err := startFakeNatsServer()
+	if err != nil {
+		t.Fatalf("startFakeNatsServer: %s", err)
+	}
+	deadHost, deadPort := deadListener.host()
+	deadListener.close() // closed before Connect, so this member refuses connections
+
+	aliveHost, alivePort := server.host()
+
+	adapter := NewNatsAdapter()
+	adapter.ConfigureCluster([]ServerInfo{
+		{Host: deadHost, Port: deadPort},
+		{Host: aliveHost, Port: alivePort},
+	})
+
+	if err := adapter.Connect(); err != nil {
+		t.Fatalf("expected Connect to fail over to the live cluster member, got: %s", err)
+	}
+
+	if !adapter.Ping() {
+		t.Fatal("expected adapter to be connected to the live member after failover")
+	}
+}
+
+func TestNatsAdapterOnDisconnectFiresOnDrop(t *testing.T) {
+	server, err := startFakeNatsServer()
+	if err != nil {
+		t.Fatalf("startFakeNatsServer: %s", err)
+	}
+
+	adapter := connectAdapter(t, server)
+
+	disconnected := make(chan error, 1)
+	adapter.OnDisconnect(func(err error) {
+		select {
+		case disconnected <- err:
+		default:
+		}
+	})
+
+	// yagnats.Client reconnects on its own, so dropping the connection
+	// while the server stays up just races watchForDisconnect's poll
+	// against the client's own reconnect. Taking the server down for good
+	// keeps every reconnect attempt failing, so the drop is guaranteed to
+	// still be observed on the next poll.
+	server.close()
+
+	select {
+	case err := <-disconnected:
+		if err == nil {
+			t.Fatal("expected a non-nil error from OnDisconnect")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for OnDisconnect to fire after the connection dropped")
+	}
+}
+
+func TestNatsAdapterRequestWithTimeoutCleansUpInbox(t *testing.T) {
+	server, err := startFakeNatsServer()
+	if err != nil {
+		t.Fatalf("startFakeNatsServer: %s", err)
+	}
+	defer server.close()
+
+	adapter := connectAdapter(t, server)
+
+	before := len(adapter.cachedSubscriptions())
+
+	err = adapter.RequestWithTimeout("nobody.listening", []byte("ping"), 50*time.Millisecond, func(payload []byte) {
+		t.Fatal("expected no reply, since nothing is subscribed to the request subject")
+	})
+	if err != nil {
+		t.Fatalf("RequestWithTimeout: %s", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	after := len(adapter.cachedSubscriptions())
+	if after != before {
+		t.Fatalf("expected the inbox subscription to be cleaned up after timeout, had %d before and %d after", before, after)
+	}
+}
+
+func TestNatsAdapterRequestMany(t *testing.T) {
+	server, err := startFakeNatsServer()
+	if err != nil {
+		t.Fatalf("startFakeNatsServer: %s", err)
+	}
+	defer server.close()
+
+	responderA := connectAdapter(t, server)
+	responderB := connectAdapter(t, server)
+	responderA.RespondToChannel("fan.out", func(payload []byte) []byte { return []byte("from-a") })
+	responderB.RespondToChannel("fan.out", func(payload []byte) []byte { return []byte("from-b") })
+
+	requester := connectAdapter(t, server)
+
+	var mu sync.Mutex
+	var replies []string
+	done := make(chan struct{})
+
+	err = requester.RequestMany("fan.out", []byte("ping"), time.Second, 2, func(payload []byte) {
+		mu.Lock()
+		replies = append(replies, string(payload))
+		if len(replies) == 2 {
+			close(done)
+		}
+		mu.Unlock()
+	})
+	if err != nil {
+		t.Fatalf("RequestMany: %s", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for both responders to reply")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(replies) != 2 {
+		t.Fatalf("expected 2 replies, got %d: %v", len(replies), replies)
+	}
+}
+
+func TestNatsAdapterSubscribeWithQueueLoadBalances(t *testing.T) {
+	server, err := startFakeNatsServer()
+	if err != nil {
+		t.Fatalf("startFakeNatsServer: %s", err)
+	}
+	defer server.close()
+
+	adapter := connectAdapter(t, server)
+
+	var mu sync.Mutex
+	counts := map[string]int{}
+
+	adapter.SubscribeWithQueue("work", "workers", func(payload []byte) {
+		mu.Lock()
+		counts["a"]++
+		mu.Unlock()
+	})
+	adapter.SubscribeWithQueue("work", "workers", func(payload []byte) {
+		mu.Lock()
+		counts["b"]++
+		mu.Unlock()
+	})
+
+	const messageCount = 10
+	for i := 0; i < messageCount; i++ {
+		if err := adapter.Publish("work", []byte("x")); err != nil {
+			t.Fatalf("Publish: %s", err)
+		}
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		total := counts["a"] + counts["b"]
+		mu.Unlock()
+		if total == messageCount {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for all messages to be delivered, got %d of %d", total, messageCount)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if counts["a"] == 0 || counts["b"] == 0 {
+		t.Fatalf("expected the queue group to load-balance across both subscribers, got %v", counts)
+	}
+}
+
+func TestNatsAdapterRequestWithHeartbeatSurvivesSlowReply(t *testing.T) {
+	server, err := startFakeNatsServer()
+	if err != nil {
+		t.Fatalf("startFakeNatsServer: %s", err)
+	}
+	defer server.close()
+
+	responder := connectAdapter(t, server)
+	responder.RespondToChannelWithHeartbeat("slow.echo", 30*time.Millisecond, 0, func(payload []byte) []byte {
+		time.Sleep(150 * time.Millisecond)
+		return payload
+	})
+
+	requester := connectAdapter(t, server)
+
+	var peerLost int32
+	requester.OnPeerLost(func(subject string) {
+		atomic.StoreInt32(&peerLost, 1)
+	})
+
+	reply := make(chan []byte, 1)
+	err = requester.RequestWithHeartbeat("slow.echo", []byte("ping"), 80*time.Millisecond, func(payload []byte) {
+		reply <- payload
+	})
+	if err != nil {
+		t.Fatalf("RequestWithHeartbeat: %s", err)
+	}
+
+	select {
+	case payload := <-reply:
+		if string(payload) != "ping" {
+			t.Fatalf("expected reply %q, got %q", "ping", payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the delayed reply")
+	}
+
+	if atomic.LoadInt32(&peerLost) != 0 {
+		t.Fatal("expected OnPeerLost not to fire while heartbeats kept arriving during the slow reply")
+	}
+}
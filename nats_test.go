@@ -0,0 +1,32 @@
+package cfmessagebus
+
+import "testing"
+
+func TestSubscribeTypedWithCodecRejectsNilPrototype(t *testing.T) {
+	adapter := NewNatsAdapter()
+
+	err := adapter.SubscribeTypedWithCodec("foo", nil, JSONCodec{}, func(v interface{}) {})
+	if err == nil {
+		t.Fatal("expected an error for a nil prototype, got nil")
+	}
+}
+
+func TestNatsAdapterMethodsWithoutConnectionFail(t *testing.T) {
+	adapter := NewNatsAdapter()
+
+	if adapter.Ping() {
+		t.Fatal("expected Ping to report down before Connect")
+	}
+
+	if err := adapter.Publish("foo", []byte("bar")); err == nil {
+		t.Fatal("expected Publish before Connect to fail")
+	}
+
+	if err := adapter.UnsubscribeAll(); err == nil {
+		t.Fatal("expected UnsubscribeAll before Connect to fail")
+	}
+
+	if err := adapter.Subscribe("foo", func(payload []byte) {}); err == nil {
+		t.Fatal("expected Subscribe before Connect to fail")
+	}
+}